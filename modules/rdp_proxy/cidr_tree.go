@@ -0,0 +1,121 @@
+package rdp_proxy
+
+import (
+    "fmt"
+    "net"
+    "strings"
+)
+
+// ruleAction is the policy associated with a CIDR entry in a cidrTree.
+type ruleAction int
+
+const (
+    ruleIntercept ruleAction = iota
+    ruleIgnore
+    ruleRedirect
+    ruleDrop
+)
+
+func parseRuleAction(s string) (ruleAction, error) {
+    switch strings.ToLower(s) {
+    case "intercept":
+        return ruleIntercept, nil
+    case "ignore":
+        return ruleIgnore, nil
+    case "redirect":
+        return ruleRedirect, nil
+    case "drop":
+        return ruleDrop, nil
+    }
+    return ruleIntercept, fmt.Errorf("invalid rdp.proxy.rules action '%s', expected intercept, ignore, redirect or drop", s)
+}
+
+// rdpRule is the policy a cidrTree entry resolves to for a matching target.
+type rdpRule struct {
+    action ruleAction
+    cidr   string
+}
+
+// cidrTree is a binary trie over IPv4 addresses, analogous to nebula's
+// cidr.Tree6 allow-list, except each terminal node carries an *rdpRule
+// instead of a bool. Lookups return the rule of the most specific (longest)
+// matching prefix.
+type cidrTree struct {
+    root *cidrNode
+}
+
+type cidrNode struct {
+    left, right *cidrNode
+    rule        *rdpRule
+}
+
+func newCidrTree() *cidrTree {
+    return &cidrTree{root: &cidrNode{}}
+}
+
+// insert adds network -> rule to the tree, overwriting any rule previously
+// registered for that exact prefix.
+func (t *cidrTree) insert(network *net.IPNet, rule *rdpRule) error {
+    ip := network.IP.To4()
+    if ip == nil {
+        return fmt.Errorf("%s is not a valid IPv4 network", network.String())
+    }
+
+    ones, _ := network.Mask.Size()
+    node := t.root
+    for i := 0; i < ones; i++ {
+        if bitAt(ip, i) == 0 {
+            if node.left == nil {
+                node.left = &cidrNode{}
+            }
+            node = node.left
+        } else {
+            if node.right == nil {
+                node.right = &cidrNode{}
+            }
+            node = node.right
+        }
+    }
+    node.rule = rule
+    return nil
+}
+
+// lookup walks the trie for ip and returns the rule of the longest matching
+// prefix, or nil if nothing in the tree covers it.
+func (t *cidrTree) lookup(ip net.IP) *rdpRule {
+    v4 := ip.To4()
+    if v4 == nil {
+        return nil
+    }
+
+    node := t.root
+    var match *rdpRule
+    for i := 0; i < 32 && node != nil; i++ {
+        if node.rule != nil {
+            match = node.rule
+        }
+        if bitAt(v4, i) == 0 {
+            node = node.left
+        } else {
+            node = node.right
+        }
+    }
+    if node != nil && node.rule != nil {
+        match = node.rule
+    }
+    return match
+}
+
+func bitAt(ip net.IP, bit int) byte {
+    return (ip[bit/8] >> uint(7-bit%8)) & 1
+}
+
+// parseCIDR is like net.ParseCIDR but also accepts a bare IP address, which
+// it treats as a /32.
+func parseCIDR(s string) (*net.IPNet, error) {
+    if !strings.Contains(s, "/") {
+        s = s + "/32"
+    }
+    _, network, err := net.ParseCIDR(s)
+    return network, err
+}
@@ -0,0 +1,87 @@
+package rdp_proxy
+
+import (
+    "net"
+    "testing"
+)
+
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+    t.Helper()
+    network, err := parseCIDR(s)
+    if err != nil {
+        t.Fatalf("parseCIDR(%q): %v", s, err)
+    }
+    return network
+}
+
+func TestCidrTreeLongestPrefixMatch(t *testing.T) {
+    tree := newCidrTree()
+
+    wide := &rdpRule{action: ruleIgnore, cidr: "10.0.0.0/8"}
+    narrow := &rdpRule{action: ruleRedirect, cidr: "10.0.1.0/24"}
+    exact := &rdpRule{action: ruleDrop, cidr: "10.0.1.5/32"}
+
+    if err := tree.insert(mustParseCIDR(t, wide.cidr), wide); err != nil {
+        t.Fatalf("insert %s: %v", wide.cidr, err)
+    }
+    if err := tree.insert(mustParseCIDR(t, narrow.cidr), narrow); err != nil {
+        t.Fatalf("insert %s: %v", narrow.cidr, err)
+    }
+    if err := tree.insert(mustParseCIDR(t, exact.cidr), exact); err != nil {
+        t.Fatalf("insert %s: %v", exact.cidr, err)
+    }
+
+    cases := []struct {
+        ip   string
+        want *rdpRule
+    }{
+        {"10.0.1.5", exact},   // matches all three, most specific wins
+        {"10.0.1.6", narrow},  // matches wide and narrow, narrow wins
+        {"10.0.2.1", wide},    // matches only wide
+        {"192.168.1.1", nil},  // matches nothing
+    }
+
+    for _, c := range cases {
+        got := tree.lookup(net.ParseIP(c.ip))
+        if got != c.want {
+            t.Errorf("lookup(%s) = %v, want %v", c.ip, got, c.want)
+        }
+    }
+}
+
+func TestParseCIDRBareIP(t *testing.T) {
+    network, err := parseCIDR("192.168.1.1")
+    if err != nil {
+        t.Fatalf("parseCIDR: %v", err)
+    }
+
+    ones, bits := network.Mask.Size()
+    if ones != 32 || bits != 32 {
+        t.Errorf("mask = /%d (of %d), want /32", ones, bits)
+    }
+}
+
+func TestParseRuleAction(t *testing.T) {
+    cases := []struct {
+        in      string
+        want    ruleAction
+        wantErr bool
+    }{
+        {"intercept", ruleIntercept, false},
+        {"IGNORE", ruleIgnore, false},
+        {"redirect", ruleRedirect, false},
+        {"drop", ruleDrop, false},
+        {"bogus", ruleIntercept, true},
+    }
+
+    for _, c := range cases {
+        got, err := parseRuleAction(c.in)
+        if (err != nil) != c.wantErr {
+            t.Errorf("parseRuleAction(%q) error = %v, wantErr %v", c.in, err, c.wantErr)
+            continue
+        }
+        if got != c.want {
+            t.Errorf("parseRuleAction(%q) = %v, want %v", c.in, got, c.want)
+        }
+    }
+}
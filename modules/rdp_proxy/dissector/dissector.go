@@ -0,0 +1,126 @@
+// Package dissector is a minimal, read-only parser for the start of the RDP
+// connection sequence (TPKT / X.224), in the spirit of clash's
+// component/sniffer: it extracts just enough of the handshake to tell the
+// caller who is connecting and how, without needing a full protocol stack
+// and without ever writing back to the wire.
+package dissector
+
+import (
+    "encoding/binary"
+    "errors"
+    "strings"
+)
+
+// SecurityProtocol is the PROTOCOL_* bitmask negotiated in the RDP
+// Negotiation Request/Response of the X.224 Connection Request/Confirm.
+type SecurityProtocol uint32
+
+const (
+    ProtocolRDP      SecurityProtocol = 0
+    ProtocolSSL      SecurityProtocol = 1 << 0
+    ProtocolHybrid   SecurityProtocol = 1 << 1
+    ProtocolRDSTLS   SecurityProtocol = 1 << 2
+    ProtocolHybridEx SecurityProtocol = 1 << 3
+)
+
+// RequestsHybrid reports whether the client asked for CredSSP (HYBRID or
+// HYBRID_EX), i.e. whether it will perform NLA on its own. When it did not,
+// isNLAEnforced's two-probe check is redundant: the client has already told
+// us it won't speak CredSSP.
+func (p SecurityProtocol) RequestsHybrid() bool {
+    return p&ProtocolHybrid != 0 || p&ProtocolHybridEx != 0
+}
+
+// Handshake is what we managed to extract from an RDP Connection Request
+// captured off the wire. Every field is best-effort: a zero value means that
+// part of the handshake either wasn't present in the captured bytes or
+// wasn't recognized.
+//
+// The client build/name and channel list that the GCC Client Core Data
+// carries are not captured here: that data rides on the later MCS Connect
+// Initial packet, which by the time it arrives has already been NATed away
+// from the NFQUEUE queue handleRdpConnection runs on, so there's nothing to
+// parse it from in normal operation.
+type Handshake struct {
+    Cookie             string
+    MSTSHash           string
+    RequestedProtocols SecurityProtocol
+}
+
+var (
+    errShortTPKT  = errors.New("dissector: payload too short to contain a TPKT header")
+    errNotTPKT    = errors.New("dissector: not a TPKT packet (unexpected version)")
+    errShortX224  = errors.New("dissector: payload too short to contain an X.224 CR TPDU")
+    errNotX224CR  = errors.New("dissector: not an X.224 Connection Request TPDU")
+)
+
+const (
+    tpktVersion = 3
+    x224TPDUCR  = 0xe0
+    rdpNegReq   = 0x01
+)
+
+// ParseConnectionRequest parses the TPKT/X.224 Connection Request TPDU at
+// the start of payload, returning the routing token/cookie, the mstshash
+// token and the requested security protocols. It does not require the
+// rest of the MCS Connect Initial to be present.
+func ParseConnectionRequest(payload []byte) (*Handshake, error) {
+    if len(payload) < 4 {
+        return nil, errShortTPKT
+    }
+    if payload[0] != tpktVersion {
+        return nil, errNotTPKT
+    }
+
+    tpktLen := int(binary.BigEndian.Uint16(payload[2:4]))
+    if tpktLen < 4 || tpktLen > len(payload) {
+        tpktLen = len(payload)
+    }
+
+    body := payload[4:tpktLen]
+    if len(body) < 7 {
+        return nil, errShortX224
+    }
+
+    // X.224 TPDU fixed header: length indicator(1), code(1), dst-ref(2),
+    // src-ref(2), class option(1) = 7 bytes; the variable part starts right
+    // after it.
+    if body[1] != x224TPDUCR {
+        return nil, errNotX224CR
+    }
+
+    userData := body[7:]
+
+    h := &Handshake{}
+
+    // The routing token / cookie, when present, is a CRLF-terminated ASCII
+    // line such as "Cookie: mstshash=alice\r\n" or a load-balancer routing
+    // token.
+    if idx := indexCRLF(userData); idx >= 0 {
+        line := string(userData[:idx])
+        h.Cookie = line
+
+        if at := strings.Index(line, "mstshash="); at >= 0 {
+            h.MSTSHash = line[at+len("mstshash="):]
+        }
+
+        userData = userData[idx+2:]
+    }
+
+    // Optional RDP Negotiation Request: type(1)=0x01, flags(1), length(2,
+    // always 8, little endian), requestedProtocols(4, little endian).
+    if len(userData) >= 8 && userData[0] == rdpNegReq {
+        h.RequestedProtocols = SecurityProtocol(binary.LittleEndian.Uint32(userData[4:8]))
+    }
+
+    return h, nil
+}
+
+func indexCRLF(b []byte) int {
+    for i := 0; i+1 < len(b); i++ {
+        if b[i] == '\r' && b[i+1] == '\n' {
+            return i
+        }
+    }
+    return -1
+}
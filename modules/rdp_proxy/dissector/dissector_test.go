@@ -0,0 +1,127 @@
+package dissector
+
+import (
+    "encoding/binary"
+    "testing"
+)
+
+// buildConnectionRequest assembles a minimal TPKT/X.224 Connection Request
+// TPDU carrying the given cookie line (CRLF-terminated, may be empty to omit
+// it) and, if requestedProtocols >= 0, an RDP Negotiation Request.
+func buildConnectionRequest(cookie string, requestedProtocols int64) []byte {
+    var userData []byte
+    userData = append(userData, []byte(cookie)...)
+
+    if requestedProtocols >= 0 {
+        negReq := make([]byte, 8)
+        negReq[0] = rdpNegReq
+        negReq[1] = 0 // flags
+        binary.LittleEndian.PutUint16(negReq[2:4], 8)
+        binary.LittleEndian.PutUint32(negReq[4:8], uint32(requestedProtocols))
+        userData = append(userData, negReq...)
+    }
+
+    // X.224 CR TPDU fixed header: length indicator, code, dst-ref(2),
+    // src-ref(2), class option.
+    x224 := []byte{0x00, x224TPDUCR, 0x00, 0x00, 0x00, 0x00, 0x00}
+    x224[0] = byte(len(x224) - 1 + len(userData))
+    body := append(x224, userData...)
+
+    tpkt := make([]byte, 4)
+    tpkt[0] = tpktVersion
+    tpkt[1] = 0
+    binary.BigEndian.PutUint16(tpkt[2:4], uint16(4+len(body)))
+
+    return append(tpkt, body...)
+}
+
+func TestParseConnectionRequest(t *testing.T) {
+    cases := []struct {
+        name               string
+        cookie             string
+        requestedProtocols int64
+        wantMSTSHash       string
+        wantProtocols      SecurityProtocol
+    }{
+        {
+            name:               "cookie and hybrid request",
+            cookie:             "Cookie: mstshash=alice\r\n",
+            requestedProtocols: int64(ProtocolHybrid),
+            wantMSTSHash:       "alice",
+            wantProtocols:      ProtocolHybrid,
+        },
+        {
+            // A direct mstsc.exe connection with no gateway sends neither a
+            // routing token nor (on older clients) a negotiation request.
+            name:               "no cookie line, no negotiation request",
+            cookie:             "",
+            requestedProtocols: -1,
+            wantMSTSHash:       "",
+            wantProtocols:      ProtocolRDP,
+        },
+        {
+            name:               "no cookie line, negotiation request still parses",
+            cookie:             "",
+            requestedProtocols: int64(ProtocolSSL),
+            wantMSTSHash:       "",
+            wantProtocols:      ProtocolSSL,
+        },
+    }
+
+    for _, c := range cases {
+        t.Run(c.name, func(t *testing.T) {
+            payload := buildConnectionRequest(c.cookie, c.requestedProtocols)
+
+            h, err := ParseConnectionRequest(payload)
+            if err != nil {
+                t.Fatalf("ParseConnectionRequest: %v", err)
+            }
+
+            if h.MSTSHash != c.wantMSTSHash {
+                t.Errorf("MSTSHash = %q, want %q", h.MSTSHash, c.wantMSTSHash)
+            }
+            if h.RequestedProtocols != c.wantProtocols {
+                t.Errorf("RequestedProtocols = 0x%x, want 0x%x", uint32(h.RequestedProtocols), uint32(c.wantProtocols))
+            }
+        })
+    }
+}
+
+func TestParseConnectionRequestErrors(t *testing.T) {
+    cases := []struct {
+        name    string
+        payload []byte
+    }{
+        {"too short for TPKT", []byte{0x03, 0x00, 0x00}},
+        {"not TPKT", []byte{0x02, 0x00, 0x00, 0x0b, 0x00, 0xe0, 0x00, 0x00, 0x00, 0x00, 0x00}},
+        {"too short for X.224", []byte{0x03, 0x00, 0x00, 0x06, 0x00, 0xe0}},
+        {"not a connection request", []byte{0x03, 0x00, 0x00, 0x0b, 0x00, 0xf0, 0x00, 0x00, 0x00, 0x00, 0x00}},
+    }
+
+    for _, c := range cases {
+        t.Run(c.name, func(t *testing.T) {
+            if _, err := ParseConnectionRequest(c.payload); err == nil {
+                t.Errorf("expected an error, got nil")
+            }
+        })
+    }
+}
+
+func TestRequestsHybrid(t *testing.T) {
+    cases := []struct {
+        protocols SecurityProtocol
+        want      bool
+    }{
+        {ProtocolRDP, false},
+        {ProtocolSSL, false},
+        {ProtocolHybrid, true},
+        {ProtocolHybridEx, true},
+        {ProtocolSSL | ProtocolHybrid, true},
+    }
+
+    for _, c := range cases {
+        if got := c.protocols.RequestsHybrid(); got != c.want {
+            t.Errorf("SecurityProtocol(0x%x).RequestsHybrid() = %v, want %v", uint32(c.protocols), got, c.want)
+        }
+    }
+}
@@ -0,0 +1,90 @@
+package rdp_proxy
+
+import (
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// nlaCacheEntry is the last NLA verdict known for a given target, along with
+// when it expires. A target that errored out (unreachable, timeout) is
+// cached exactly like a successful probe so that a dead host isn't re-probed
+// on every retransmit of the same flow.
+type nlaCacheEntry struct {
+    nla     bool
+    err     error
+    expires time.Time
+}
+
+func (e *nlaCacheEntry) expired(now time.Time) bool {
+    return now.After(e.expires)
+}
+
+// nlaCache is a TTL cache of NLA verdicts keyed by "host:port", mirroring the
+// firewall connection cache pattern of short-lived, periodically swept
+// entries guarded by a single RWMutex.
+type nlaCache struct {
+    mutex   sync.RWMutex
+    entries map[string]*nlaCacheEntry
+    ttl     time.Duration
+
+    hits   uint64
+    misses uint64
+}
+
+func newNlaCache(ttl time.Duration) *nlaCache {
+    return &nlaCache{
+        entries: make(map[string]*nlaCacheEntry),
+        ttl:     ttl,
+    }
+}
+
+func (c *nlaCache) get(target string) (nla bool, err error, found bool) {
+    c.mutex.RLock()
+    entry, ok := c.entries[target]
+    c.mutex.RUnlock()
+
+    if !ok || entry.expired(time.Now()) {
+        atomic.AddUint64(&c.misses, 1)
+        return false, nil, false
+    }
+
+    atomic.AddUint64(&c.hits, 1)
+    return entry.nla, entry.err, true
+}
+
+func (c *nlaCache) put(target string, nla bool, err error) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    c.entries[target] = &nlaCacheEntry{
+        nla:     nla,
+        err:     err,
+        expires: time.Now().Add(c.ttl),
+    }
+}
+
+// sweep drops every expired entry, so a long running proxy doesn't keep
+// growing the map with targets that will never be seen again.
+func (c *nlaCache) sweep() {
+    now := time.Now()
+
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    for target, entry := range c.entries {
+        if entry.expired(now) {
+            delete(c.entries, target)
+        }
+    }
+}
+
+func (c *nlaCache) counters() (hits uint64, misses uint64) {
+    return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
+
+// nlaProbeResult is the outcome of a single verifyNLA call, passed back over
+// a channel so the two probes required by isNLAEnforced can run concurrently.
+type nlaProbeResult struct {
+    nla bool
+    err error
+}
@@ -0,0 +1,85 @@
+package rdp_proxy
+
+import (
+    "errors"
+    "testing"
+    "time"
+)
+
+func TestNlaCacheGetPut(t *testing.T) {
+    c := newNlaCache(time.Minute)
+
+    if _, _, found := c.get("10.0.0.1:3389"); found {
+        t.Fatalf("get on empty cache returned found=true")
+    }
+
+    c.put("10.0.0.1:3389", true, nil)
+
+    nla, err, found := c.get("10.0.0.1:3389")
+    if !found {
+        t.Fatalf("get after put returned found=false")
+    }
+    if !nla {
+        t.Errorf("nla = false, want true")
+    }
+    if err != nil {
+        t.Errorf("err = %v, want nil", err)
+    }
+
+    probeErr := errors.New("dial tcp: timeout")
+    c.put("10.0.0.2:3389", false, probeErr)
+
+    nla, err, found = c.get("10.0.0.2:3389")
+    if !found || nla || err != probeErr {
+        t.Errorf("get(10.0.0.2:3389) = (%v, %v, %v), want (false, %v, true)", nla, err, found, probeErr)
+    }
+}
+
+func TestNlaCacheExpiry(t *testing.T) {
+    c := newNlaCache(time.Millisecond)
+    c.put("10.0.0.1:3389", true, nil)
+
+    time.Sleep(5 * time.Millisecond)
+
+    if _, _, found := c.get("10.0.0.1:3389"); found {
+        t.Errorf("get returned found=true for an expired entry")
+    }
+}
+
+func TestNlaCacheSweep(t *testing.T) {
+    c := newNlaCache(time.Millisecond)
+    c.put("expired:3389", true, nil)
+
+    time.Sleep(5 * time.Millisecond)
+
+    c.put("fresh:3389", true, nil)
+    c.sweep()
+
+    c.mutex.RLock()
+    _, expiredStillThere := c.entries["expired:3389"]
+    _, freshStillThere := c.entries["fresh:3389"]
+    c.mutex.RUnlock()
+
+    if expiredStillThere {
+        t.Errorf("sweep did not remove the expired entry")
+    }
+    if !freshStillThere {
+        t.Errorf("sweep removed a non-expired entry")
+    }
+}
+
+func TestNlaCacheCounters(t *testing.T) {
+    c := newNlaCache(time.Minute)
+    c.put("10.0.0.1:3389", true, nil)
+
+    c.get("10.0.0.1:3389") // hit
+    c.get("10.0.0.2:3389") // miss
+
+    hits, misses := c.counters()
+    if hits != 1 {
+        t.Errorf("hits = %d, want 1", hits)
+    }
+    if misses != 1 {
+        t.Errorf("misses = %d, want 1", misses)
+    }
+}
